@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
+
+	"k8s.io/test-infra/prow/pod-utils/downwardapi"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+// metadataFormatJSON is always emitted; it cannot be disabled via
+// --metadata-format.
+const metadataFormatJSON = "json"
+
+var metadataMarshalers = map[string]func(interface{}) ([]byte, error){
+	"yaml": yaml.Marshal,
+	"toml": marshalTOML,
+}
+
+func marshalTOML(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := toml.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// customMetadataFilename is the name a step can use, in any of its artifact
+// directories, to contribute additional fields to metadata.json.
+const customMetadataFilename = "custom-prow-metadata.json"
+
+// defaultCustomMetadataMaxDepth bounds how many directory levels below
+// artifactDir are searched for custom-prow-metadata.json files.
+const defaultCustomMetadataMaxDepth = 5
+
+type options struct {
+	artifactDir string
+	jobSpec     *api.JobSpec
+	namespace   string
+
+	sanitizeRulesFile string
+
+	customMetadataMaxDepth   int
+	customMetadataSchemaFile string
+
+	metadataFormatsRaw string
+	metadataFormats    []string
+}
+
+func gatherOptions() (*options, error) {
+	o := &options{}
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	fs.StringVar(&o.artifactDir, "artifact-dir", "", "Directory to write job artifacts to.")
+	fs.StringVar(&o.namespace, "namespace", "", "Namespace the job is running in.")
+	fs.StringVar(&o.sanitizeRulesFile, "sanitize-rules", "", "Path to a YAML/JSON file of additional log sanitization rules to apply on top of the built-in ones.")
+	fs.IntVar(&o.customMetadataMaxDepth, "custom-metadata-max-depth", defaultCustomMetadataMaxDepth, "Maximum number of directory levels below --artifact-dir to search for custom-prow-metadata.json files.")
+	fs.StringVar(&o.customMetadataSchemaFile, "custom-metadata-schema", "", "Path to a JSON Schema that custom-prow-metadata.json files must satisfy; files that fail validation are skipped and reported.")
+	fs.StringVar(&o.metadataFormatsRaw, "metadata-format", metadataFormatJSON, "Comma-separated list of formats to emit the result metadata in, in addition to metadata.json: json, yaml, toml.")
+
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, fmt.Errorf("could not parse flags: %v", err)
+	}
+
+	formats, err := parseMetadataFormats(o.metadataFormatsRaw)
+	if err != nil {
+		return nil, err
+	}
+	o.metadataFormats = formats
+
+	jobSpec, err := downwardapi.ResolveSpecFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve job spec: %v", err)
+	}
+	o.jobSpec = &api.JobSpec{JobSpec: *jobSpec}
+
+	return o, nil
+}
+
+// parseMetadataFormats validates and normalizes the --metadata-format flag.
+// json is always included, whether or not the caller asked for it, since
+// metadata.json is never optional.
+func parseMetadataFormats(raw string) ([]string, error) {
+	seen := map[string]bool{metadataFormatJSON: true}
+	formats := []string{metadataFormatJSON}
+	for _, format := range strings.Split(raw, ",") {
+		format = strings.TrimSpace(format)
+		if format == "" || seen[format] {
+			continue
+		}
+		if format != metadataFormatJSON {
+			if _, ok := metadataMarshalers[format]; !ok {
+				return nil, fmt.Errorf("unknown --metadata-format %q: must be one of json, yaml, toml", format)
+			}
+			formats = append(formats, format)
+		}
+		seen[format] = true
+	}
+	return formats, nil
+}
+
+// Complete finishes setting up the options that require I/O, such as
+// loading the optional sanitize rules file.
+func (o *options) Complete() error {
+	if o.sanitizeRulesFile == "" {
+		return nil
+	}
+	rules, err := loadSanitizeRulesFile(o.sanitizeRulesFile)
+	if err != nil {
+		return fmt.Errorf("could not load sanitize rules from %s: %v", o.sanitizeRulesFile, err)
+	}
+	sanitizeRules = append(rules, sanitizeRules...)
+	return nil
+}
+
+func main() {
+	o, err := gatherOptions()
+	if err != nil {
+		logrus.WithError(err).Fatal("could not resolve options")
+	}
+	if err := o.Complete(); err != nil {
+		logrus.WithError(err).Fatal("could not complete options")
+	}
+	if err := o.writeMetadataJSON(); err != nil {
+		logrus.WithError(err).Fatal("could not write metadata")
+	}
+}
+
+// prowResultMetadata mirrors the structure Prow's metadata.json takes, with
+// the addition of the free-form Metadata field filled in from any
+// custom-prow-metadata.json files steps leave in their artifact directories.
+type prowResultMetadata struct {
+	Revision      int               `json:"revision" yaml:"revision" toml:"revision"`
+	RepoCommit    string            `json:"repo-commit" yaml:"repo-commit" toml:"repo-commit"`
+	Repo          string            `json:"repo" yaml:"repo" toml:"repo"`
+	Repos         map[string]string `json:"repos" yaml:"repos" toml:"repos"`
+	InfraCommit   string            `json:"infra-commit" yaml:"infra-commit" toml:"infra-commit"`
+	JobVersion    string            `json:"job-version" yaml:"job-version" toml:"job-version"`
+	Pod           string            `json:"pod" yaml:"pod" toml:"pod"`
+	WorkNamespace string            `json:"work-namespace" yaml:"work-namespace" toml:"work-namespace"`
+	Metadata      map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty" toml:"metadata"`
+
+	// StepMetadata groups the same data in Metadata by the step/pod
+	// directory name whose custom-prow-metadata.json contributed it, so
+	// consumers can tell which step produced which value. Metadata is kept
+	// alongside it for backward compatibility.
+	StepMetadata map[string]map[string]string `json:"step-metadata,omitempty" yaml:"step-metadata,omitempty" toml:"step-metadata"`
+
+	// ConflictingMetadata records, per key, every distinct value seen across
+	// the custom-prow-metadata.json files that disagreed on it. Metadata
+	// keeps whichever value was discovered first rather than silently
+	// overwriting it.
+	ConflictingMetadata map[string][]string `json:"conflicting-metadata,omitempty" yaml:"conflicting-metadata,omitempty" toml:"conflicting-metadata"`
+
+	// MetadataValidationErrors lists, one entry per rejected file, why a
+	// custom-prow-metadata.json failed --custom-metadata-schema validation
+	// and was skipped.
+	MetadataValidationErrors []string `json:"metadata-validation-errors,omitempty" yaml:"metadata-validation-errors,omitempty" toml:"metadata-validation-errors"`
+}
+
+// writeMetadataJSON aggregates the job's own identity with any custom
+// metadata steps have dropped into their artifact directories and writes the
+// result to metadata.json in the artifact directory.
+func (o *options) writeMetadataJSON() error {
+	refs := o.jobSpec.Refs
+	metadata := prowResultMetadata{
+		Repo:          fmt.Sprintf("%s/%s", refs.Org, refs.Repo),
+		Repos:         map[string]string{fmt.Sprintf("%s/%s", refs.Org, refs.Repo): refs.BaseSHA},
+		Pod:           o.jobSpec.ProwJobID,
+		WorkNamespace: o.namespace,
+	}
+	for _, extraRef := range o.jobSpec.ExtraRefs {
+		metadata.Repos[fmt.Sprintf("%s/%s", extraRef.Org, extraRef.Repo)] = extraRef.BaseSHA
+	}
+
+	metadataFile := filepath.Join(o.artifactDir, "metadata.json")
+	var previousRevision int
+	var previousMetadata map[string]string
+	if previous, err := readProwResultMetadata(metadataFile); err == nil {
+		previousRevision = previous.Revision
+		previousMetadata = previous.Metadata
+	}
+
+	var schema *gojsonschema.Schema
+	if o.customMetadataSchemaFile != "" {
+		var err error
+		schema, err = loadMetadataSchema(o.customMetadataSchemaFile)
+		if err != nil {
+			return fmt.Errorf("could not load custom metadata schema %s: %v", o.customMetadataSchemaFile, err)
+		}
+	}
+
+	maxDepth := o.customMetadataMaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultCustomMetadataMaxDepth
+	}
+	customMetadata, stepMetadata, conflicts, validationErrors, err := gatherCustomMetadata(o.artifactDir, maxDepth, schema)
+	if err != nil {
+		return fmt.Errorf("could not gather custom metadata: %v", err)
+	}
+	metadata.Metadata = customMetadata
+	metadata.StepMetadata = stepMetadata
+	metadata.ConflictingMetadata = conflicts
+	metadata.MetadataValidationErrors = validationErrors
+
+	metadata.Revision = previousRevision + 1
+	if previousRevision > 0 && reflect.DeepEqual(customMetadata, previousMetadata) {
+		metadata.Revision = previousRevision
+	}
+
+	contents, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal prow metadata: %v", err)
+	}
+	if err := ioutil.WriteFile(metadataFile, contents, 0644); err != nil {
+		return fmt.Errorf("could not write prow metadata: %v", err)
+	}
+
+	for _, format := range o.metadataFormats {
+		marshal, ok := metadataMarshalers[format]
+		if !ok {
+			continue // json, already written above
+		}
+		formatted, err := marshal(metadata)
+		if err != nil {
+			return fmt.Errorf("could not marshal prow metadata as %s: %v", format, err)
+		}
+		formatFile := filepath.Join(o.artifactDir, fmt.Sprintf("metadata.%s", format))
+		if err := ioutil.WriteFile(formatFile, formatted, 0644); err != nil {
+			return fmt.Errorf("could not write %s: %v", formatFile, err)
+		}
+	}
+	return nil
+}
+
+func readProwResultMetadata(path string) (*prowResultMetadata, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var metadata prowResultMetadata
+	if err := json.Unmarshal(contents, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// loadMetadataSchema compiles the JSON Schema used to validate
+// custom-prow-metadata.json files before they're merged.
+func loadMetadataSchema(path string) (*gojsonschema.Schema, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve path: %v", err)
+	}
+	return gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + absPath))
+}
+
+// gatherCustomMetadata walks artifactDir, bounded to maxDepth directory
+// levels, merging every custom-prow-metadata.json it finds (in lexical,
+// depth-first order). Keys written with the same value more than once are
+// merged normally; keys written with conflicting values are kept at their
+// first-seen value and reported in the returned conflicts map instead of
+// being silently overwritten. If schema is non-nil, files that don't
+// validate against it are skipped and reported in validationErrors rather
+// than merged. The same data is also returned grouped by stepDir, the
+// top-level artifactDir subdirectory (step/pod directory) each file was
+// found under.
+func gatherCustomMetadata(artifactDir string, maxDepth int, schema *gojsonschema.Schema) (merged map[string]string, stepMetadata map[string]map[string]string, conflicts map[string][]string, validationErrors []string, err error) {
+	merged = map[string]string{}
+	byStep := map[string]map[string]string{}
+	conflictValues := map[string]map[string]struct{}{}
+
+	walkErr := filepath.Walk(artifactDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			rel, relErr := filepath.Rel(artifactDir, path)
+			if relErr == nil && rel != "." {
+				depth := len(strings.Split(filepath.ToSlash(rel), "/"))
+				if depth > maxDepth {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if info.Name() != customMetadataFilename {
+			return nil
+		}
+
+		contents, readErr := ioutil.ReadFile(path)
+		if readErr != nil {
+			return readErr
+		}
+
+		if schema != nil {
+			result, validateErr := schema.Validate(gojsonschema.NewBytesLoader(contents))
+			if validateErr != nil {
+				validationErrors = append(validationErrors, fmt.Sprintf("%s: %v", path, validateErr))
+				logrus.WithError(validateErr).WithField("file", path).Warn("could not validate custom metadata file against schema, ignoring")
+				return nil
+			}
+			if !result.Valid() {
+				var reasons []string
+				for _, resultErr := range result.Errors() {
+					reasons = append(reasons, resultErr.String())
+				}
+				validationErrors = append(validationErrors, fmt.Sprintf("%s: %s", path, strings.Join(reasons, "; ")))
+				logrus.WithField("file", path).Warn("custom metadata file failed schema validation, ignoring")
+				return nil
+			}
+		}
+
+		var fileMetadata map[string]string
+		if jsonErr := json.Unmarshal(contents, &fileMetadata); jsonErr != nil {
+			logrus.WithError(jsonErr).WithField("file", path).Warn("could not unmarshal custom metadata file, ignoring")
+			return nil
+		}
+
+		stepDir := stepDirFor(artifactDir, path)
+		if byStep[stepDir] == nil {
+			byStep[stepDir] = map[string]string{}
+		}
+
+		for k, v := range fileMetadata {
+			byStep[stepDir][k] = v
+
+			existing, seen := merged[k]
+			if !seen {
+				merged[k] = v
+				continue
+			}
+			if existing == v {
+				continue
+			}
+			if conflictValues[k] == nil {
+				conflictValues[k] = map[string]struct{}{existing: {}}
+			}
+			conflictValues[k][v] = struct{}{}
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, nil, nil, nil, walkErr
+	}
+
+	if len(conflictValues) > 0 {
+		conflicts = map[string][]string{}
+		for k, values := range conflictValues {
+			var list []string
+			for v := range values {
+				list = append(list, v)
+			}
+			sort.Strings(list)
+			conflicts[k] = list
+		}
+	}
+
+	if len(merged) == 0 {
+		merged = nil
+	}
+	if len(byStep) == 0 {
+		byStep = nil
+	}
+	return merged, byStep, conflicts, validationErrors, nil
+}
+
+// stepDirFor returns the step/pod directory a custom-prow-metadata.json was
+// found in: the first path component of path relative to artifactDir, or
+// artifactDir's own base name if the file sits directly in artifactDir.
+func stepDirFor(artifactDir, path string) string {
+	rel, err := filepath.Rel(artifactDir, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return filepath.Base(artifactDir)
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	return parts[0]
+}
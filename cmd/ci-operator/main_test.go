@@ -227,6 +227,9 @@ func verifyMetadata(org string,
 
 	expectedMetadata.Revision = revision
 	expectedMetadata.Metadata = customMetadata
+	if hasCustomMetadata {
+		expectedMetadata.StepMetadata = map[string]map[string]string{filepath.Base(testArtifactDirectory): customMetadata}
+	}
 	if !reflect.DeepEqual(expectedMetadata, writtenMetadata) {
 		return fmt.Errorf("written metadata does not match expected metadata (second revision): %s", cmp.Diff(expectedMetadata, writtenMetadata))
 	}
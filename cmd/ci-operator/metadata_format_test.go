@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/pod-utils/downwardapi"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+func TestGatherCustomMetadataStepGrouping(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gather-custom-metadata-steps")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	writeFile(t, filepath.Join(tempDir, "unit", customMetadataFilename), `{"shared-field": "from-unit", "unit-only": "u"}`)
+	writeFile(t, filepath.Join(tempDir, "e2e", "nested", customMetadataFilename), `{"shared-field": "from-e2e"}`)
+
+	_, stepMetadata, _, _, err := gatherCustomMetadata(tempDir, defaultCustomMetadataMaxDepth, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]map[string]string{
+		"unit": {"shared-field": "from-unit", "unit-only": "u"},
+		"e2e":  {"shared-field": "from-e2e"},
+	}
+	if !reflect.DeepEqual(stepMetadata, expected) {
+		t.Errorf("stepMetadata = %#v, expected %#v", stepMetadata, expected)
+	}
+}
+
+func TestWriteMetadataJSONMultiFormatRoundTrip(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "write-metadata-formats")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	writeFile(t, filepath.Join(tempDir, "unit", customMetadataFilename), `{"custom-field": "custom-value"}`)
+
+	o := &options{
+		artifactDir: tempDir,
+		jobSpec: &api.JobSpec{
+			JobSpec: downwardapi.JobSpec{
+				Refs:      &prowapi.Refs{Org: "some-org", Repo: "some-repo"},
+				ProwJobID: "some-prow-job-id",
+			},
+		},
+		namespace:       "test-namespace",
+		metadataFormats: []string{metadataFormatJSON, "yaml", "toml"},
+	}
+	if err := o.writeMetadataJSON(); err != nil {
+		t.Fatalf("writeMetadataJSON() returned error: %v", err)
+	}
+
+	jsonContents, err := ioutil.ReadFile(filepath.Join(tempDir, "metadata.json"))
+	if err != nil {
+		t.Fatalf("could not read metadata.json: %v", err)
+	}
+	var fromJSON prowResultMetadata
+	if err := json.Unmarshal(jsonContents, &fromJSON); err != nil {
+		t.Fatalf("could not unmarshal metadata.json: %v", err)
+	}
+
+	yamlContents, err := ioutil.ReadFile(filepath.Join(tempDir, "metadata.yaml"))
+	if err != nil {
+		t.Fatalf("could not read metadata.yaml: %v", err)
+	}
+	var fromYAML prowResultMetadata
+	if err := yaml.Unmarshal(yamlContents, &fromYAML); err != nil {
+		t.Fatalf("could not unmarshal metadata.yaml: %v", err)
+	}
+	assertSameCore(t, "yaml", fromJSON, fromYAML)
+
+	tomlContents, err := ioutil.ReadFile(filepath.Join(tempDir, "metadata.toml"))
+	if err != nil {
+		t.Fatalf("could not read metadata.toml: %v", err)
+	}
+	var fromTOML prowResultMetadata
+	if err := toml.Unmarshal(tomlContents, &fromTOML); err != nil {
+		t.Fatalf("could not unmarshal metadata.toml: %v", err)
+	}
+	assertSameCore(t, "toml", fromJSON, fromTOML)
+}
+
+// assertSameCore compares the fields every format is expected to round-trip
+// identically, skipping the slice/map fields whose "absent" representation
+// (nil vs. empty) legitimately differs across encodings.
+func assertSameCore(t *testing.T, format string, want, got prowResultMetadata) {
+	t.Helper()
+	if got.Revision != want.Revision || got.Repo != want.Repo || got.Pod != want.Pod || got.WorkNamespace != want.WorkNamespace {
+		t.Errorf("metadata.%s core fields differ from metadata.json: got %#v, want %#v", format, got, want)
+	}
+	if !reflect.DeepEqual(got.Repos, want.Repos) {
+		t.Errorf("metadata.%s Repos differs from metadata.json: got %#v, want %#v", format, got.Repos, want.Repos)
+	}
+	if !reflect.DeepEqual(got.Metadata, want.Metadata) {
+		t.Errorf("metadata.%s Metadata differs from metadata.json: got %#v, want %#v", format, got.Metadata, want.Metadata)
+	}
+	if !reflect.DeepEqual(got.StepMetadata, want.StepMetadata) {
+		t.Errorf("metadata.%s StepMetadata differs from metadata.json: got %#v, want %#v", format, got.StepMetadata, want.StepMetadata)
+	}
+}
+
+func TestParseMetadataFormats(t *testing.T) {
+	tests := []struct {
+		raw         string
+		expected    []string
+		expectError bool
+	}{
+		{raw: "json", expected: []string{"json"}},
+		{raw: "json,yaml", expected: []string{"json", "yaml"}},
+		{raw: "yaml,toml", expected: []string{"json", "yaml", "toml"}},
+		{raw: "yaml,yaml", expected: []string{"json", "yaml"}},
+		{raw: "xml", expectError: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.raw, func(t *testing.T) {
+			got, err := parseMetadataFormats(tc.raw)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("parseMetadataFormats(%q) = %#v, expected %#v", tc.raw, got, tc.expected)
+			}
+		})
+	}
+}
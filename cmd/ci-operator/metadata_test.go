@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("could not create directory for %s: %v", path, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("could not write %s: %v", path, err)
+	}
+}
+
+func TestGatherCustomMetadataRecursive(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gather-custom-metadata")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	writeFile(t, filepath.Join(tempDir, "unit", customMetadataFilename), `{"unit-field": "unit-value"}`)
+	writeFile(t, filepath.Join(tempDir, "e2e", "nested", customMetadataFilename), `{"nested-field": "nested-value"}`)
+	writeFile(t, filepath.Join(tempDir, "e2e", "nested", "too-deep", "way-too-deep", customMetadataFilename), `{"too-deep-field": "should-not-appear"}`)
+
+	merged, _, conflicts, validationErrors, err := gatherCustomMetadata(tempDir, 2, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"unit-field": "unit-value", "nested-field": "nested-value"}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("merged = %#v, expected %#v", merged, expected)
+	}
+	if conflicts != nil {
+		t.Errorf("expected no conflicts, got %#v", conflicts)
+	}
+	if validationErrors != nil {
+		t.Errorf("expected no validation errors, got %#v", validationErrors)
+	}
+}
+
+func TestGatherCustomMetadataConflicts(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gather-custom-metadata-conflicts")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	writeFile(t, filepath.Join(tempDir, "unit", customMetadataFilename), `{"shared-field": "from-unit"}`)
+	writeFile(t, filepath.Join(tempDir, "e2e", customMetadataFilename), `{"shared-field": "from-e2e"}`)
+
+	merged, _, conflicts, _, err := gatherCustomMetadata(tempDir, defaultCustomMetadataMaxDepth, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if merged["shared-field"] != "from-unit" {
+		t.Errorf("expected first-seen value %q to win, got %q", "from-unit", merged["shared-field"])
+	}
+	values := conflicts["shared-field"]
+	sort.Strings(values)
+	expected := []string{"from-e2e", "from-unit"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("conflicting values = %#v, expected %#v", values, expected)
+	}
+}
+
+func TestGatherCustomMetadataSchemaValidation(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gather-custom-metadata-schema")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	schemaFile := filepath.Join(tempDir, "schema.json")
+	writeFile(t, schemaFile, `{
+		"type": "object",
+		"properties": {"valid-field": {"type": "string"}},
+		"additionalProperties": false
+	}`)
+
+	writeFile(t, filepath.Join(tempDir, "good", customMetadataFilename), `{"valid-field": "ok"}`)
+	writeFile(t, filepath.Join(tempDir, "bad", customMetadataFilename), `{"unexpected-field": "nope"}`)
+
+	schema, err := loadMetadataSchema(schemaFile)
+	if err != nil {
+		t.Fatalf("could not load schema: %v", err)
+	}
+
+	merged, _, _, validationErrors, err := gatherCustomMetadata(tempDir, defaultCustomMetadataMaxDepth, schema)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := merged["valid-field"]; !ok {
+		t.Errorf("expected valid file's field to be merged, got %#v", merged)
+	}
+	if _, ok := merged["unexpected-field"]; ok {
+		t.Errorf("expected invalid file's field to be skipped, got %#v", merged)
+	}
+	if len(validationErrors) != 1 {
+		t.Fatalf("expected exactly one validation error, got %#v", validationErrors)
+	}
+}
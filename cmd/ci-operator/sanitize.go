@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// sanitizeRule describes a single redaction applied by sanitizeMessage. It
+// doubles as the on-disk schema for --sanitize-rules files, so operators can
+// extend the built-in set without a code change.
+type sanitizeRule struct {
+	Name        string `json:"name" yaml:"name"`
+	Pattern     string `json:"pattern" yaml:"pattern"`
+	Replacement string `json:"replacement" yaml:"replacement"`
+
+	compiled *regexp.Regexp
+}
+
+// sanitizeRules is the ordered list of rules sanitizeMessage applies. It
+// starts out as the built-in rules below and Complete() prepends any rules
+// loaded from --sanitize-rules, so operator-supplied rules always get first
+// crack at a message.
+var sanitizeRules = compiledDefaultSanitizeRules()
+
+// defaultSanitizeRules returns the built-in redactions: the original set
+// covering ci-operator's own log output (pod names, step durations, ISO
+// dates, UUIDs), plus the common secret/PII shapes seen in CI logs.
+func defaultSanitizeRules() []sanitizeRule {
+	return []sanitizeRule{
+		{Name: "pod-name", Pattern: `\bci-op-[0-9a-z]+\b`, Replacement: "<PODNAME>"},
+		{Name: "duration", Pattern: `\b(?:\d+h\s*)?(?:\d+m\s*)?\d+(?:\.\d+)?(?:ms|s)\b`, Replacement: "<DURATION>"},
+		{Name: "iso-datetime", Pattern: `\d{4}-\d{2}-\d{2}(?:T\d{2}:\d{2}:\d{2}Z)?`, Replacement: "<ISO-DATETIME>"},
+		{Name: "uuid", Pattern: `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`, Replacement: "<UUID>"},
+		{Name: "bearer-token", Pattern: `Bearer [A-Za-z0-9\-_=]+`, Replacement: "Bearer <TOKEN>"},
+		{Name: "kubeconfig-blob", Pattern: `(?i)(kubeconfig[\s"']*[:=][\s"']*)[A-Za-z0-9+/=]{40,}`, Replacement: "${1}<SECRET>"},
+		{Name: "aws-access-key", Pattern: `AKIA[0-9A-Z]{16}`, Replacement: "<SECRET>"},
+		{Name: "email", Pattern: `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`, Replacement: "<EMAIL>"},
+		{Name: "ipv4", Pattern: `\b(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\b`, Replacement: "<IP>"},
+		{Name: "ipv6", Pattern: `\b(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}\b`, Replacement: "<IP>"},
+		{Name: "sha256-digest", Pattern: `\b[0-9a-fA-F]{64}\b`, Replacement: "<DIGEST>"},
+	}
+}
+
+func compiledDefaultSanitizeRules() []sanitizeRule {
+	compiled, err := compileSanitizeRules(defaultSanitizeRules())
+	if err != nil {
+		panic(fmt.Sprintf("built-in sanitize rules failed to compile: %v", err))
+	}
+	return compiled
+}
+
+func compileSanitizeRules(rules []sanitizeRule) ([]sanitizeRule, error) {
+	compiled := make([]sanitizeRule, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: invalid pattern %q: %v", rule.Name, rule.Pattern, err)
+		}
+		rule.compiled = re
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+// loadSanitizeRulesFile reads a YAML or JSON file (valid JSON is valid YAML)
+// listing additional sanitize rules and compiles them.
+func loadSanitizeRulesFile(path string) ([]sanitizeRule, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %v", err)
+	}
+	var rules []sanitizeRule
+	if err := yaml.Unmarshal(raw, &rules); err != nil {
+		return nil, fmt.Errorf("could not parse file: %v", err)
+	}
+	return compileSanitizeRules(rules)
+}
+
+// sanitizeMessage scrubs a log message of the configured sanitizeRules, in
+// order, so operator-supplied rules (prepended ahead of the built-ins by
+// Complete()) always take precedence.
+func sanitizeMessage(message string) string {
+	for _, rule := range sanitizeRules {
+		message = rule.compiled.ReplaceAllString(message, rule.Replacement)
+	}
+	return message
+}
@@ -0,0 +1,14 @@
+// Package api holds the types ci-operator and its supporting tooling share
+// across packages.
+package api
+
+import (
+	"k8s.io/test-infra/prow/pod-utils/downwardapi"
+)
+
+// JobSpec wraps the upstream Prow downward API JobSpec, giving ci-tools a
+// place to hang additional, ci-operator-specific fields without forking the
+// upstream type.
+type JobSpec struct {
+	downwardapi.JobSpec
+}
@@ -0,0 +1,183 @@
+package rehearse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+// Filter decides whether a single Presubmit should be rehearsed. Mirrors
+// the comment/trigger filter abstraction test-infra's `/test` and
+// `/retest` handling was refactored onto (see pjutil/filter.go), so
+// rehearsals can be driven by more than "everything whose ci-operator
+// config changed in this PR": ExecuteJobs is handed a slice of Filters and
+// unions their results over the full set of candidate Presubmits.
+//
+// forced reports whether this Filter wants job to run regardless of its
+// own defaults (an explicit request, as opposed to e.g. a changed-configs
+// match); defaults reports whether shouldRun reflects the job's own
+// default behavior rather than an override. Both are metadata for callers
+// that want to explain *why* a job was (or wasn't) selected -- ExecuteJobs
+// itself only needs shouldRun.
+type Filter interface {
+	ShouldRun(job prowconfig.Presubmit) (shouldRun, forced, defaults bool)
+}
+
+// ChangedPresubmitFilter matches every Presubmit it's handed. It exists so
+// today's default -- rehearse everything whose ci-operator config changed
+// in this PR -- is expressed as a Filter like any other; the actual diff
+// against the PR is done by whatever builds the candidate list ExecuteJobs
+// is called with.
+type ChangedPresubmitFilter struct{}
+
+// ShouldRun always matches: a changed-configs candidate list is already
+// scoped to jobs that should run.
+func (ChangedPresubmitFilter) ShouldRun(prowconfig.Presubmit) (shouldRun, forced, defaults bool) {
+	return true, false, true
+}
+
+// rehearseCommandPattern matches a single `/rehearse job-name` PR comment,
+// the rehearsal analogue of prow's `/test job-name`.
+var rehearseCommandPattern = regexp.MustCompile(`(?m)^/rehearse\s+([\w.-]+)\s*$`)
+
+// rehearseAllPattern matches a `/rehearse all` PR comment.
+var rehearseAllPattern = regexp.MustCompile(`(?m)^/rehearse\s+all\s*$`)
+
+// CommandFilter matches Presubmits named explicitly in `/rehearse
+// job-name` PR comments.
+type CommandFilter struct {
+	jobs sets.String
+}
+
+// NewCommandFilter scans comments for `/rehearse job-name` commands and
+// returns a Filter matching the named jobs.
+func NewCommandFilter(comments []string) CommandFilter {
+	jobs := sets.NewString()
+	for _, comment := range comments {
+		for _, match := range rehearseCommandPattern.FindAllStringSubmatch(comment, -1) {
+			jobs.Insert(match[1])
+		}
+	}
+	return CommandFilter{jobs: jobs}
+}
+
+// ShouldRun matches job.Name against the jobs named by `/rehearse
+// job-name` comments. A match is forced: it asks for the job regardless
+// of whether its config actually changed.
+func (f CommandFilter) ShouldRun(job prowconfig.Presubmit) (shouldRun, forced, defaults bool) {
+	if f.jobs.Has(job.Name) {
+		return true, true, false
+	}
+	return false, false, false
+}
+
+// AllFilter matches every Presubmit once a `/rehearse all` PR comment has
+// been seen.
+type AllFilter struct {
+	matched bool
+}
+
+// NewAllFilter scans comments for a `/rehearse all` command.
+func NewAllFilter(comments []string) AllFilter {
+	for _, comment := range comments {
+		if rehearseAllPattern.MatchString(comment) {
+			return AllFilter{matched: true}
+		}
+	}
+	return AllFilter{}
+}
+
+// ShouldRun matches every job once `/rehearse all` has been requested; the
+// match, like CommandFilter's, is forced.
+func (f AllFilter) ShouldRun(prowconfig.Presubmit) (shouldRun, forced, defaults bool) {
+	return f.matched, f.matched, false
+}
+
+// AllowlistConfig is the on-disk schema for a RegexAllowlistFilter's
+// config file. JobNames are matched verbatim; JobPatterns are compiled as
+// regexps against the job name; Labels matches any job carrying one of the
+// given label key=value pairs.
+type AllowlistConfig struct {
+	JobNames    []string          `json:"job_names,omitempty" yaml:"job_names,omitempty"`
+	JobPatterns []string          `json:"job_patterns,omitempty" yaml:"job_patterns,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// RegexAllowlistFilter matches Presubmits named, pattern-matched, or
+// labeled in an operator-maintained allow-list, so rehearsals can be
+// opted into for jobs that don't otherwise change or get called out in a
+// PR comment.
+type RegexAllowlistFilter struct {
+	names    sets.String
+	patterns []*regexp.Regexp
+	labels   map[string]string
+}
+
+// LoadAllowlistFilter reads and compiles the allow-list at path.
+func LoadAllowlistFilter(path string) (*RegexAllowlistFilter, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read rehearsal allow-list %s: %v", path, err)
+	}
+	var cfg AllowlistConfig
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("could not parse rehearsal allow-list %s: %v", path, err)
+	}
+
+	patterns := make([]*regexp.Regexp, 0, len(cfg.JobPatterns))
+	for _, p := range cfg.JobPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("rehearsal allow-list %s: invalid job pattern %q: %v", path, p, err)
+		}
+		patterns = append(patterns, re)
+	}
+
+	return &RegexAllowlistFilter{
+		names:    sets.NewString(cfg.JobNames...),
+		patterns: patterns,
+		labels:   cfg.Labels,
+	}, nil
+}
+
+// ShouldRun matches job against the allow-list's names, patterns, and
+// labels, in that order.
+func (f *RegexAllowlistFilter) ShouldRun(job prowconfig.Presubmit) (shouldRun, forced, defaults bool) {
+	if f.names.Has(job.Name) {
+		return true, false, true
+	}
+	for _, re := range f.patterns {
+		if re.MatchString(job.Name) {
+			return true, false, true
+		}
+	}
+	for key, value := range f.labels {
+		if job.Labels[key] == value {
+			return true, false, true
+		}
+	}
+	return false, false, false
+}
+
+// shouldRehearse unions filters' verdicts on job: job is rehearsed if any
+// filter matches it, and the match is forced if any matching filter asked
+// for that.
+func shouldRehearse(filters []Filter, job prowconfig.Presubmit) (shouldRun, forced bool) {
+	for _, filter := range filters {
+		run, isForced, _ := filter.ShouldRun(job)
+		if !run {
+			continue
+		}
+		shouldRun = true
+		if isForced {
+			forced = true
+		}
+	}
+	return shouldRun, forced
+}
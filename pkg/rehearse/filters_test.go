@@ -0,0 +1,273 @@
+package rehearse
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clientgo_testing "k8s.io/client-go/testing"
+
+	pjapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/client/clientset/versioned/fake"
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+func TestChangedPresubmitFilter(t *testing.T) {
+	job := *makeTestingPresubmit("some-job", "ci/prow/some-job", nil)
+	shouldRun, forced, defaults := (ChangedPresubmitFilter{}).ShouldRun(job)
+	if !shouldRun || forced || !defaults {
+		t.Errorf("ChangedPresubmitFilter.ShouldRun() = (%v, %v, %v), want (true, false, true)", shouldRun, forced, defaults)
+	}
+}
+
+func TestCommandFilter(t *testing.T) {
+	filter := NewCommandFilter([]string{
+		"some unrelated comment",
+		"/rehearse pull-ci-org-repo-master-unit\nmore text",
+		"/rehearse  pull-ci-org-repo-master-e2e  ",
+	})
+
+	testCases := []struct {
+		jobName   string
+		shouldRun bool
+	}{
+		{jobName: "pull-ci-org-repo-master-unit", shouldRun: true},
+		{jobName: "pull-ci-org-repo-master-e2e", shouldRun: true},
+		{jobName: "pull-ci-org-repo-master-lint", shouldRun: false},
+	}
+	for _, tc := range testCases {
+		job := *makeTestingPresubmit(tc.jobName, "ci/prow/"+tc.jobName, nil)
+		shouldRun, forced, defaults := filter.ShouldRun(job)
+		if shouldRun != tc.shouldRun {
+			t.Errorf("job %s: ShouldRun() = %v, want %v", tc.jobName, shouldRun, tc.shouldRun)
+		}
+		if shouldRun && !forced {
+			t.Errorf("job %s: expected an explicit /rehearse match to be forced", tc.jobName)
+		}
+		if defaults {
+			t.Errorf("job %s: expected defaults=false for an explicit match", tc.jobName)
+		}
+	}
+}
+
+func TestAllFilter(t *testing.T) {
+	testCases := []struct {
+		description string
+		comments    []string
+		shouldRun   bool
+	}{
+		{description: "no comments", shouldRun: false},
+		{description: "unrelated comment", comments: []string{"/lgtm"}, shouldRun: false},
+		{description: "/rehearse all", comments: []string{"/rehearse all"}, shouldRun: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			filter := NewAllFilter(tc.comments)
+			job := *makeTestingPresubmit("some-job", "ci/prow/some-job", nil)
+			shouldRun, forced, _ := filter.ShouldRun(job)
+			if shouldRun != tc.shouldRun {
+				t.Errorf("ShouldRun() = %v, want %v", shouldRun, tc.shouldRun)
+			}
+			if shouldRun != forced {
+				t.Errorf("expected forced == shouldRun, got forced=%v shouldRun=%v", forced, shouldRun)
+			}
+		})
+	}
+}
+
+func TestRegexAllowlistFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rehearse-allowlist")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "allowlist.yaml")
+	config := `
+job_names:
+- pull-ci-org-repo-master-explicit
+job_patterns:
+- ^pull-ci-org-repo-master-e2e-.*$
+labels:
+  rehearse.ci.openshift.org/always: "true"
+`
+	if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	filter, err := LoadAllowlistFilter(configPath)
+	if err != nil {
+		t.Fatalf("LoadAllowlistFilter() returned an error: %v", err)
+	}
+
+	testCases := []struct {
+		description string
+		job         prowconfig.Presubmit
+		shouldRun   bool
+	}{{
+		description: "matched by name",
+		job:         *makeTestingPresubmit("pull-ci-org-repo-master-explicit", "ci/prow/explicit", nil),
+		shouldRun:   true,
+	}, {
+		description: "matched by pattern",
+		job:         *makeTestingPresubmit("pull-ci-org-repo-master-e2e-aws", "ci/prow/e2e-aws", nil),
+		shouldRun:   true,
+	}, {
+		description: "matched by label",
+		job: func() prowconfig.Presubmit {
+			job := *makeTestingPresubmit("pull-ci-org-repo-master-unit", "ci/prow/unit", nil)
+			job.Labels["rehearse.ci.openshift.org/always"] = "true"
+			return job
+		}(),
+		shouldRun: true,
+	}, {
+		description: "no match",
+		job:         *makeTestingPresubmit("pull-ci-org-repo-master-lint", "ci/prow/lint", nil),
+		shouldRun:   false,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			shouldRun, forced, defaults := filter.ShouldRun(tc.job)
+			if shouldRun != tc.shouldRun {
+				t.Errorf("ShouldRun() = %v, want %v", shouldRun, tc.shouldRun)
+			}
+			if forced {
+				t.Errorf("expected an allow-list match not to be forced")
+			}
+			if shouldRun != defaults {
+				t.Errorf("expected defaults == shouldRun, got defaults=%v shouldRun=%v", defaults, shouldRun)
+			}
+		})
+	}
+}
+
+func TestLoadAllowlistFilterMissingFile(t *testing.T) {
+	if _, err := LoadAllowlistFilter("/no/such/file.yaml"); err == nil {
+		t.Error("expected an error loading a non-existent allow-list, got none")
+	}
+}
+
+func TestLoadAllowlistFilterBadPattern(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rehearse-allowlist")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "allowlist.yaml")
+	if err := ioutil.WriteFile(configPath, []byte("job_patterns:\n- '[unterminated'\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	if _, err := LoadAllowlistFilter(configPath); err == nil {
+		t.Error("expected an error loading an allow-list with an invalid pattern, got none")
+	}
+}
+
+// stubFilter is a Filter whose verdict is fixed at construction, for
+// testing shouldRehearse's union and conflict handling in isolation.
+type stubFilter struct {
+	shouldRun, forced, defaults bool
+}
+
+func (f stubFilter) ShouldRun(prowconfig.Presubmit) (shouldRun, forced, defaults bool) {
+	return f.shouldRun, f.forced, f.defaults
+}
+
+func TestShouldRehearse(t *testing.T) {
+	job := *makeTestingPresubmit("some-job", "ci/prow/some-job", nil)
+	testCases := []struct {
+		description string
+		filters     []Filter
+		wantRun     bool
+		wantForced  bool
+	}{{
+		description: "no filters",
+	}, {
+		description: "single non-matching filter",
+		filters:     []Filter{stubFilter{shouldRun: false}},
+	}, {
+		description: "single matching, non-forced filter",
+		filters:     []Filter{stubFilter{shouldRun: true, defaults: true}},
+		wantRun:     true,
+	}, {
+		description: "single matching, forced filter",
+		filters:     []Filter{stubFilter{shouldRun: true, forced: true}},
+		wantRun:     true,
+		wantForced:  true,
+	}, {
+		description: "conflict: one filter excludes, another includes -- union wins",
+		filters: []Filter{
+			stubFilter{shouldRun: false},
+			stubFilter{shouldRun: true, forced: true},
+		},
+		wantRun:    true,
+		wantForced: true,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			shouldRun, forced := shouldRehearse(tc.filters, job)
+			if shouldRun != tc.wantRun || forced != tc.wantForced {
+				t.Errorf("shouldRehearse() = (%v, %v), want (%v, %v)", shouldRun, forced, tc.wantRun, tc.wantForced)
+			}
+		})
+	}
+}
+
+func TestExecuteJobsFilters(t *testing.T) {
+	testPrNumber, testNamespace, testRepoPath, testRefs := makeTestData()
+	targetRepo := "targetOrg/targetRepo"
+	candidates := map[string][]prowconfig.Presubmit{targetRepo: {
+		*makeTestingPresubmit("job-changed", "ci/prow/job-changed", []string{"arg1"}),
+		*makeTestingPresubmit("job-commanded", "ci/prow/job-commanded", []string{"arg2"}),
+		*makeTestingPresubmit("job-untouched", "ci/prow/job-untouched", []string{"arg3"}),
+	}}
+
+	fakecs := fake.NewSimpleClientset()
+	fakeclient := fakecs.ProwV1().ProwJobs(testNamespace)
+	var submitted []string
+	fakecs.PrependReactor("create", "prowjobs", func(action clientgo_testing.Action) (bool, runtime.Object, error) {
+		job := action.(clientgo_testing.CreateAction).GetObject().(*pjapi.ProwJob)
+		submitted = append(submitted, job.Spec.Job)
+		return false, nil, nil
+	})
+	fakecs.Fake.PrependWatchReactor("prowjobs", makeImmediateSuccessReactor(fakeclient))
+
+	changedFilter := stubChangedFilter{names: sets.NewString("job-changed")}
+	commandFilter := NewCommandFilter([]string{"/rehearse job-commanded"})
+
+	testLoggers := Loggers{logrus.New(), logrus.New()}
+	executor := &Executor{ReleaseRepoPath: testRepoPath, Refs: testRefs, DryRun: true, Loggers: testLoggers, Client: fakeclient}
+
+	success, err := executor.ExecuteJobs(context.Background(), candidates, []Filter{changedFilter, commandFilter}, testPrNumber)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !success {
+		t.Fatalf("expected success=true")
+	}
+
+	sort.Strings(submitted)
+	expected := []string{"rehearse-123-job-changed", "rehearse-123-job-commanded"}
+	if !reflect.DeepEqual(submitted, expected) {
+		t.Errorf("expected exactly %v to be submitted, got %v", expected, submitted)
+	}
+}
+
+// stubChangedFilter matches only the job names it's constructed with,
+// standing in for a real changed-configs diff in TestExecuteJobsFilters.
+type stubChangedFilter struct {
+	names sets.String
+}
+
+func (f stubChangedFilter) ShouldRun(job prowconfig.Presubmit) (shouldRun, forced, defaults bool) {
+	return f.names.Has(job.Name), false, true
+}
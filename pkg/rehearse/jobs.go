@@ -0,0 +1,455 @@
+// Package rehearse knows how to take Prow presubmit job configuration that
+// changed in a PR and submit "rehearsal" copies of those jobs against the PR
+// itself, so reviewers can see the effect of a config change before it
+// merges.
+package rehearse
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	pjapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	pj "k8s.io/test-infra/prow/client/clientset/versioned/typed/prowjobs/v1"
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+// rehearseLabel is set on every rehearsal Presubmit/ProwJob this package
+// creates, carrying the PR number that triggered the rehearsal.
+const rehearseLabel = "ci.openshift.org/rehearse"
+
+// ciOperatorConfigsCMName is the name of the ConfigMap ci-operator configs
+// are mirrored into; a Presubmit's env var referencing it is inlined rather
+// than mounted, since rehearsals run before the ConfigMap is updated.
+const ciOperatorConfigsCMName = "ci-operator-configs"
+
+// Loggers bundles the two loggers rehearsals report through: Job carries
+// operator-facing, human-readable output, while Debug carries verbose
+// diagnostics useful when something goes wrong.
+type Loggers struct {
+	Job, Debug *logrus.Logger
+}
+
+// ciOpConfigLoader loads the contents of a ci-operator configuration file
+// for a given repo. It exists so tests can substitute a fake; in production
+// it reads from a checkout of the release repo.
+type ciOpConfigLoader interface {
+	Load(repo, configFile string) (string, error)
+}
+
+// primaryContainerAnnotation names the ci-operator container in a Presubmit
+// that runs more than one container (sidecars, init containers mounting
+// credential/CA volumes, etc). Borrowed from the same pattern Katib uses for
+// its trial templates. Jobs with a single container don't need it: that
+// container is always the primary one.
+const primaryContainerAnnotation = "ci.openshift.org/primary-container"
+
+// primaryContainerIndex locates the container the rehearse logic must
+// mutate (append --git-ref to, inline ci-operator config env vars into).
+// Everything else on the PodSpec -- other containers, volumes, init
+// containers -- is passed through untouched.
+func primaryContainerIndex(job *prowconfig.Presubmit) (int, error) {
+	containers := job.Spec.Containers
+	if name := job.Annotations[primaryContainerAnnotation]; name != "" {
+		for i := range containers {
+			if containers[i].Name == name {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("job %s: primary container %q (from %s annotation) not found", job.Name, name, primaryContainerAnnotation)
+	}
+	if len(containers) != 1 {
+		return 0, fmt.Errorf("job %s: must set a %s annotation to rehearse jobs with more than one container", job.Name, primaryContainerAnnotation)
+	}
+	return 0, nil
+}
+
+// inlineCiOpConfig replaces any env var in job's primary container that
+// references the ci-operator-configs ConfigMap with the literal content of
+// the file it points at, since rehearsals run against the PR's own copy of
+// that content rather than whatever is currently mirrored into the cluster.
+func inlineCiOpConfig(job *prowconfig.Presubmit, targetRepo string, configs ciOpConfigLoader, loggers Loggers) (*prowconfig.Presubmit, error) {
+	primary, err := primaryContainerIndex(job)
+	if err != nil {
+		return nil, err
+	}
+	container := job.Spec.Containers[primary]
+
+	var newEnv []v1.EnvVar
+	if len(container.Env) > 0 {
+		newEnv = make([]v1.EnvVar, len(container.Env))
+		copy(newEnv, container.Env)
+	}
+
+	for index, env := range newEnv {
+		if env.ValueFrom == nil || env.ValueFrom.ConfigMapKeyRef == nil {
+			continue
+		}
+		ref := env.ValueFrom.ConfigMapKeyRef
+		if ref.Name != ciOperatorConfigsCMName {
+			continue
+		}
+
+		content, err := configs.Load(targetRepo, ref.Key)
+		if err != nil {
+			return nil, fmt.Errorf("could not inline ci-operator config %s/%s: %v", targetRepo, ref.Key, err)
+		}
+		loggers.Debug.WithFields(logrus.Fields{"repo": targetRepo, "file": ref.Key}).Debug("inlined ci-operator config")
+		newEnv[index] = v1.EnvVar{Name: env.Name, Value: content}
+	}
+
+	newContainer := container
+	newContainer.Env = newEnv
+
+	newJob := *job
+	newSpec := *job.Spec
+	newContainers := make([]v1.Container, len(job.Spec.Containers))
+	copy(newContainers, job.Spec.Containers)
+	newContainers[primary] = newContainer
+	newSpec.Containers = newContainers
+	newJob.Spec = &newSpec
+
+	return &newJob, nil
+}
+
+// makeRehearsalPresubmit turns a Presubmit that changed in repo into a
+// rehearsal: a copy that targets the PR's own code (via --git-ref) instead
+// of whatever is merged. The primary container (see primaryContainerIndex)
+// must invoke ci-operator, not already be pinned to a --git-ref, and the
+// job must run over exactly one branch; everything else on the PodSpec --
+// other containers, volumes, init containers -- passes through untouched.
+func makeRehearsalPresubmit(source *prowconfig.Presubmit, repo string, prNumber int) (*prowconfig.Presubmit, error) {
+	if len(source.Brancher.Branches) != 1 {
+		return nil, fmt.Errorf("job %s: cannot rehearse jobs that run over multiple branches", source.Name)
+	}
+
+	primary, err := primaryContainerIndex(source)
+	if err != nil {
+		return nil, err
+	}
+	container := source.Spec.Containers[primary]
+	if len(container.Command) == 0 || container.Command[0] != "ci-operator" {
+		return nil, fmt.Errorf("job %s: cannot rehearse jobs whose primary container does not invoke ci-operator", source.Name)
+	}
+	for _, arg := range container.Args {
+		if strings.HasPrefix(arg, "--git-ref") {
+			return nil, fmt.Errorf("job %s: cannot rehearse jobs that already set --git-ref", source.Name)
+		}
+	}
+
+	branch := strings.Trim(source.Brancher.Branches[0], "^$")
+
+	newArgs := make([]string, len(container.Args), len(container.Args)+1)
+	copy(newArgs, container.Args)
+	newArgs = append(newArgs, fmt.Sprintf("--git-ref=%s@%s", repo, branch))
+
+	newContainer := container
+	newContainer.Args = newArgs
+
+	rehearsal := *source
+	rehearsal.Name = fmt.Sprintf("rehearse-%d-%s", prNumber, source.Name)
+	rehearsal.Context = fmt.Sprintf("ci/rehearse/%s/%s", repo, strings.TrimPrefix(source.Context, "ci/prow/"))
+	rehearsal.Labels = map[string]string{rehearseLabel: strconv.Itoa(prNumber)}
+
+	newContainers := make([]v1.Container, len(source.Spec.Containers))
+	copy(newContainers, source.Spec.Containers)
+	newContainers[primary] = newContainer
+
+	newSpec := *source.Spec
+	newSpec.Containers = newContainers
+	rehearsal.Spec = &newSpec
+
+	return &rehearsal, nil
+}
+
+// prowJobForRehearsal builds the ProwJob Prow needs to actually schedule a
+// rehearsal Presubmit against refs.
+func prowJobForRehearsal(rehearsal *prowconfig.Presubmit, refs *pjapi.Refs, prNumber int) *pjapi.ProwJob {
+	return &pjapi.ProwJob{
+		TypeMeta: metav1.TypeMeta{Kind: "ProwJob", APIVersion: "prow.k8s.io/v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: rehearsal.Name,
+			Labels: map[string]string{
+				"created-by-prow":       "true",
+				"prow.k8s.io/job":       rehearsal.Name,
+				"prow.k8s.io/refs.org":  refs.Org,
+				"prow.k8s.io/refs.repo": refs.Repo,
+				"prow.k8s.io/type":      string(pjapi.PresubmitJob),
+				"prow.k8s.io/refs.pull": strconv.Itoa(prNumber),
+				rehearseLabel:           strconv.Itoa(prNumber),
+			},
+			Annotations: map[string]string{"prow.k8s.io/job": rehearsal.Name},
+		},
+		Spec: pjapi.ProwJobSpec{
+			Agent:   pjapi.ProwJobAgent(rehearsal.Agent),
+			Type:    pjapi.PresubmitJob,
+			Job:     rehearsal.Name,
+			Refs:    refs,
+			Report:  true,
+			Context: rehearsal.Context,
+			PodSpec: rehearsal.Spec,
+		},
+		Status: pjapi.ProwJobStatus{
+			StartTime: metav1.Now(),
+			State:     pjapi.TriggeredState,
+		},
+	}
+}
+
+// terminalState reports whether state is one a ProwJob won't transition out
+// of, and if so, whether it counts as a success.
+func terminalState(state pjapi.ProwJobState) (terminal, success bool) {
+	switch state {
+	case pjapi.TriggeredState, pjapi.PendingState:
+		return false, false
+	case pjapi.SuccessState:
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+// jobResult is what a single waitForJob goroutine reports back once name's
+// ProwJob has reached a terminal state (or the watch for it could not be
+// established at all, or ctx was cancelled first). name identifies which
+// job finished, since callers that fan out one waitForJob per job funnel
+// every result through a single shared channel.
+type jobResult struct {
+	name    string
+	success bool
+	err     error
+}
+
+// waitForJob watches name's own ProwJob, via a `metadata.name` field
+// selector rather than the whole namespace, until it reaches a terminal
+// state or ctx is cancelled. If the watch closes before that happens --
+// the apiserver times watches out periodically -- it is re-established and
+// watching resumes, mirroring the retry behavior waitForJobs used to
+// provide for its single cluster-wide watch.
+func waitForJob(ctx context.Context, name string, pjclient pj.ProwJobInterface, loggers Loggers) jobResult {
+	selector := fields.OneTermEqualSelector("metadata.name", name).String()
+	for {
+		watcher, err := pjclient.Watch(metav1.ListOptions{FieldSelector: selector})
+		if err != nil {
+			return jobResult{name: name, err: fmt.Errorf("failed to create a watch for ProwJob %s: %v", name, err)}
+		}
+
+		result, done := func() (jobResult, bool) {
+			defer watcher.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return jobResult{name: name, err: ctx.Err()}, true
+				case event, ok := <-watcher.ResultChan():
+					if !ok {
+						return jobResult{}, false
+					}
+					prowJob, ok := event.Object.(*pjapi.ProwJob)
+					if !ok || prowJob.Name != name {
+						continue
+					}
+
+					terminal, success := terminalState(prowJob.Status.State)
+					if !terminal {
+						continue
+					}
+					if success {
+						loggers.Job.WithField("name", name).WithField("state", prowJob.Status.State).Info("Job succeeded")
+					} else {
+						loggers.Job.WithField("name", name).WithField("state", prowJob.Status.State).Error("Job failed")
+					}
+					loggers.Debug.WithField("name", name).WithField("state", prowJob.Status.State).Debug("Processed ProwJob state change")
+
+					return jobResult{name: name, success: success}, true
+				}
+			}
+		}()
+		if done {
+			return result
+		}
+	}
+}
+
+// waitForJobs blocks until every ProwJob named in pjs reaches a terminal
+// state, returning whether all of them succeeded. releaseRepoPath is
+// reserved for future diagnostics (e.g. linking failures back to the
+// job's config) and is not otherwise used. Each job gets its own
+// goroutine watching only that job's `metadata.name`, rather than all of
+// them sharing a single cluster-wide watch filtered client-side -- on a
+// busy Prow cluster that means this process only ever sees events for the
+// rehearsals it actually submitted.
+func waitForJobs(pjs sets.String, releaseRepoPath string, pjclient pj.ProwJobInterface, loggers Loggers) (bool, error) {
+	results := make(chan jobResult)
+	for _, name := range pjs.List() {
+		name := name
+		go func() { results <- waitForJob(context.Background(), name, pjclient, loggers) }()
+	}
+
+	success := true
+	var firstErr error
+	for i := 0; i < pjs.Len(); i++ {
+		result := <-results
+		switch {
+		case result.err != nil:
+			if firstErr == nil {
+				firstErr = result.err
+			}
+		case !result.success:
+			success = false
+		}
+	}
+	if firstErr != nil {
+		return false, firstErr
+	}
+
+	return success, nil
+}
+
+// rehearsalRequest is one Presubmit still waiting to be turned into a
+// rehearsal ProwJob and submitted.
+type rehearsalRequest struct {
+	repo string
+	job  prowconfig.Presubmit
+}
+
+// Executor submits rehearsal ProwJobs for a set of changed-config
+// Presubmits and waits for them to finish, never letting more than
+// MaxConcurrent of them be outstanding at once -- borrowing the
+// acquire-a-slot-before-you-start pattern from provisioner-style worker
+// pools, so a PR touching many configs doesn't flood the Prow cluster with
+// simultaneous rehearsals. A zero MaxConcurrent means unbounded. Policy is
+// applied on top of that, bounding and excluding which Filter-selected
+// jobs are actually allowed to be rehearsed at all.
+type Executor struct {
+	MaxConcurrent   int
+	Policy          RehearsalPolicy
+	ReleaseRepoPath string
+	Refs            *pjapi.Refs
+	DryRun          bool
+	Loggers         Loggers
+	Client          pj.ProwJobInterface
+}
+
+// ExecuteJobs turns every Presubmit in candidates that any of filters
+// selects (see shouldRehearse) and e.Policy allows into a rehearsal
+// ProwJob and waits for all of them to finish, keeping at most
+// MaxConcurrent of them in flight at a time. Each submitted job is watched
+// by its own waitForJob goroutine rather than one watch shared across the
+// whole batch, so a busy cluster only ever delivers this process events for
+// the rehearsals it actually submitted. Jobs that can't be rehearsed (see
+// makeRehearsalPresubmit) are logged and skipped rather than failing the
+// whole batch. If ctx is cancelled, no further jobs are submitted and
+// whatever is still outstanding is marked Aborted; ExecuteJobs then returns
+// a partial result along with ctx.Err(), so callers can Ctrl-C a rehearsal
+// run without leaving orphaned ProwJobs behind.
+func (e *Executor) ExecuteJobs(ctx context.Context, candidates map[string][]prowconfig.Presubmit, filters []Filter, prNumber int) (bool, error) {
+	var pending []rehearsalRequest
+	for repo, jobs := range candidates {
+		for _, job := range jobs {
+			shouldRun, forced := shouldRehearse(filters, job)
+			if !shouldRun {
+				continue
+			}
+			if forced {
+				e.Loggers.Debug.WithField("job", job.Name).Debug("job selected for rehearsal by an explicit filter")
+			}
+			pending = append(pending, rehearsalRequest{repo: repo, job: job})
+		}
+	}
+	pending = e.Policy.apply(pending, e.Loggers)
+
+	maxConcurrent := e.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = len(pending)
+	}
+
+	pjs := sets.NewString()
+	// results is sized for the worst case, every pending job getting
+	// submitted and reporting back, so a waitForJob goroutine can always
+	// hand off its result and return -- even one unblocked by ctx being
+	// cancelled after the main loop below has already stopped draining it.
+	results := make(chan jobResult, len(pending))
+
+	// submitNext creates rehearsal ProwJobs until MaxConcurrent are
+	// outstanding or pending is empty, starting a waitForJob watch for each
+	// one that reports back on results once that job finishes.
+	submitNext := func() error {
+		for pjs.Len() < maxConcurrent && len(pending) > 0 {
+			req := pending[0]
+			pending = pending[1:]
+
+			rehearsal, err := makeRehearsalPresubmit(&req.job, req.repo, prNumber)
+			if err != nil {
+				e.Loggers.Job.WithError(err).WithField("job", req.job.Name).Warn("could not rehearse job, skipping")
+				continue
+			}
+			if e.DryRun {
+				e.Loggers.Debug.WithField("job", rehearsal.Name).WithField("context", rehearsal.Context).Debug("would submit rehearsal job")
+			}
+
+			created, err := e.Client.Create(prowJobForRehearsal(rehearsal, e.Refs, prNumber))
+			if err != nil {
+				return fmt.Errorf("failed to create rehearsal ProwJob for %s: %v", rehearsal.Name, err)
+			}
+			e.Loggers.Job.WithField("name", created.Name).WithField("context", rehearsal.Context).Info("submitted rehearsal job")
+			pjs.Insert(created.Name)
+			go func(name string) { results <- waitForJob(ctx, name, e.Client, e.Loggers) }(created.Name)
+		}
+		return nil
+	}
+
+	if err := submitNext(); err != nil {
+		return false, err
+	}
+
+	success := true
+	for pjs.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			e.abortAll(pjs)
+			return false, ctx.Err()
+		case result := <-results:
+			if result.err != nil {
+				// A result carrying ctx.Err() means the job's own watch
+				// noticed the cancellation before the select above did; it
+				// isn't actually resolved, so leave it in pjs and handle it
+				// exactly like a cancellation caught here.
+				if ctx.Err() != nil {
+					e.abortAll(pjs)
+					return false, ctx.Err()
+				}
+				return false, result.err
+			}
+			pjs.Delete(result.name)
+			if !result.success {
+				success = false
+			}
+			if err := submitNext(); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return success, nil
+}
+
+// abortAll marks every ProwJob named in pjs Aborted, best-effort: a failure
+// to patch one is logged, not fatal, since we're already on the shutdown
+// path.
+func (e *Executor) abortAll(pjs sets.String) {
+	for _, name := range pjs.List() {
+		patch := []byte(fmt.Sprintf(`{"status":{"state":%q}}`, pjapi.AbortedState))
+		if _, err := e.Client.Patch(name, apitypes.MergePatchType, patch); err != nil {
+			e.Loggers.Job.WithError(err).WithField("name", name).Warn("failed to mark rehearsal ProwJob aborted")
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package rehearse
 
 import (
+	"context"
 	"fmt"
 
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -15,10 +19,12 @@ import (
 
 	pjapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
 	"k8s.io/test-infra/prow/client/clientset/versioned/fake"
+	pj "k8s.io/test-infra/prow/client/clientset/versioned/typed/prowjobs/v1"
 	prowconfig "k8s.io/test-infra/prow/config"
 
 	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/diff"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -132,6 +138,37 @@ func TestInlineCiopConfig(t *testing.T) {
 	}
 }
 
+func TestInlineCiopConfigMultiContainer(t *testing.T) {
+	testLoggers := Loggers{logrus.New(), logrus.New()}
+	configs := &fakeCiopConfig{fakeFiles: map[string]string{"org/repo/filename": "ciopConfigContent"}}
+
+	job := &prowconfig.Presubmit{
+		JobBase: prowconfig.JobBase{
+			Name:        "test-job-name",
+			Annotations: map[string]string{primaryContainerAnnotation: "ci-operator"},
+			Spec: &v1.PodSpec{
+				Containers: []v1.Container{
+					{Name: "sidecar", Env: []v1.EnvVar{{Name: "T", ValueFrom: makeCMReference(ciOperatorConfigsCMName, "filename")}}},
+					{Name: "ci-operator", Env: []v1.EnvVar{{Name: "T", ValueFrom: makeCMReference(ciOperatorConfigsCMName, "filename")}}},
+				},
+			},
+		},
+	}
+
+	newJob, err := inlineCiOpConfig(job, "org/repo", configs, testLoggers)
+	if err != nil {
+		t.Fatalf("Unexpected error returned by inlineCiOpConfig(): %v", err)
+	}
+
+	if !reflect.DeepEqual(newJob.Spec.Containers[0], job.Spec.Containers[0]) {
+		t.Errorf("expected sidecar container's env to be left untouched, got %#v", newJob.Spec.Containers[0])
+	}
+	expectedEnv := []v1.EnvVar{{Name: "T", Value: "ciopConfigContent"}}
+	if !reflect.DeepEqual(newJob.Spec.Containers[1].Env, expectedEnv) {
+		t.Errorf("expected primary container's env %#v, got %#v", expectedEnv, newJob.Spec.Containers[1].Env)
+	}
+}
+
 func makeTestingPresubmit(name, context string, ciopArgs []string) *prowconfig.Presubmit {
 	return &prowconfig.Presubmit{
 		JobBase: prowconfig.JobBase{
@@ -175,6 +212,43 @@ func TestMakeRehearsalPresubmit(t *testing.T) {
 	}
 }
 
+func TestMakeRehearsalPresubmitVolumesAndSidecars(t *testing.T) {
+	volumes := []v1.Volume{{Name: "credentials"}}
+	source := &prowconfig.Presubmit{
+		JobBase: prowconfig.JobBase{
+			Agent:       "kubernetes",
+			Name:        "pull-ci-organization-repo-master-multi",
+			Labels:      map[string]string{rehearseLabel: "123"},
+			Annotations: map[string]string{primaryContainerAnnotation: "ci-operator"},
+			Spec: &v1.PodSpec{
+				Volumes: volumes,
+				Containers: []v1.Container{
+					{Name: "sidecar", Command: []string{"sleep"}, Args: []string{"infinity"}},
+					{Name: "ci-operator", Command: []string{"ci-operator"}, Args: []string{"arg"}},
+				},
+			},
+		},
+		Context:  "ci/prow/multi",
+		Brancher: prowconfig.Brancher{Branches: []string{"^master$"}},
+	}
+
+	rehearsal, err := makeRehearsalPresubmit(source, "organization/repo", 123)
+	if err != nil {
+		t.Fatalf("Unexpected error in makeRehearsalPresubmit: %v", err)
+	}
+
+	if !reflect.DeepEqual(rehearsal.Spec.Volumes, volumes) {
+		t.Errorf("expected volumes to pass through untouched, got %#v", rehearsal.Spec.Volumes)
+	}
+	if !reflect.DeepEqual(rehearsal.Spec.Containers[0], source.Spec.Containers[0]) {
+		t.Errorf("expected sidecar container to pass through untouched, got %#v", rehearsal.Spec.Containers[0])
+	}
+	expectedArgs := []string{"arg", "--git-ref=organization/repo@master"}
+	if !reflect.DeepEqual(rehearsal.Spec.Containers[1].Args, expectedArgs) {
+		t.Errorf("expected primary container args %#v, got %#v", expectedArgs, rehearsal.Spec.Containers[1].Args)
+	}
+}
+
 func TestMakeRehearsalPresubmitNegative(t *testing.T) {
 	testName := "pull-ci-organization-repo-master-test"
 	testContext := "ci/prow/test"
@@ -201,9 +275,15 @@ func TestMakeRehearsalPresubmitNegative(t *testing.T) {
 			j.Brancher.Branches = append(j.Brancher.Branches, "^feature-branch$")
 		},
 	}, {
-		description: "jobs that need additional volumes mounted",
+		description: "multi-container job with no primary-container annotation",
+		crippleFunc: func(j *prowconfig.Presubmit) {
+			j.Spec.Containers = append(j.Spec.Containers, v1.Container{Name: "sidecar"})
+		},
+	}, {
+		description: "multi-container job whose primary-container annotation matches nothing",
 		crippleFunc: func(j *prowconfig.Presubmit) {
-			j.Spec.Volumes = []v1.Volume{{Name: "volume"}}
+			j.Spec.Containers = append(j.Spec.Containers, v1.Container{Name: "sidecar"})
+			j.Annotations = map[string]string{primaryContainerAnnotation: "no-such-container"}
 		},
 	},
 	}
@@ -271,31 +351,15 @@ func makeTestData() (int, string, string, *pjapi.Refs) {
 	return testPrNumber, testNamespace, testReleasePath, testRefs
 }
 
-func makeSuccessfulFinishReactor(watcher watch.Interface, jobs map[string][]prowconfig.Presubmit) func(clientgo_testing.Action) (bool, watch.Interface, error) {
-	return func(clientgo_testing.Action) (bool, watch.Interface, error) {
-		watcher.Stop()
-		n := 0
-		for _, jobs := range jobs {
-			n += len(jobs)
-		}
-		ret := watch.NewFakeWithChanSize(n, true)
-		for event := range watcher.ResultChan() {
-			pj := event.Object.(*pjapi.ProwJob).DeepCopy()
-			pj.Status.State = pjapi.SuccessState
-			ret.Modify(pj)
-		}
-		return true, ret, nil
-	}
-}
-
 func TestExecuteJobsErrors(t *testing.T) {
 	testPrNumber, testNamespace, testRepoPath, testRefs := makeTestData()
 	targetRepo := "targetOrg/targetRepo"
 
 	testCases := []struct {
-		description string
-		jobs        map[string][]prowconfig.Presubmit
-		reactor     func(action clientgo_testing.Action) (handled bool, ret runtime.Object, err error)
+		description   string
+		jobs          map[string][]prowconfig.Presubmit
+		reactor       func(action clientgo_testing.Action) (handled bool, ret runtime.Object, err error)
+		maxConcurrent int
 	}{{
 		description: "fail to Create a prowjob",
 		jobs: map[string][]prowconfig.Presubmit{targetRepo: {
@@ -326,13 +390,17 @@ func TestExecuteJobsErrors(t *testing.T) {
 			testLoggers := Loggers{logrus.New(), logrus.New()}
 			fakecs := fake.NewSimpleClientset()
 			fakeclient := fakecs.ProwV1().ProwJobs(testNamespace)
-			watcher, err := fakeclient.Watch(metav1.ListOptions{})
-			if err != nil {
-				t.Fatalf("Failed to setup watch: %v", err)
-			}
-			fakecs.Fake.PrependWatchReactor("prowjobs", makeSuccessfulFinishReactor(watcher, tc.jobs))
+			fakecs.Fake.PrependWatchReactor("prowjobs", makeImmediateSuccessReactor(fakeclient))
 			fakecs.PrependReactor("create", "prowjobs", tc.reactor)
-			_, err = ExecuteJobs(tc.jobs, testPrNumber, testRepoPath, testRefs, true, testLoggers, fakeclient)
+			executor := &Executor{
+				MaxConcurrent:   tc.maxConcurrent,
+				ReleaseRepoPath: testRepoPath,
+				Refs:            testRefs,
+				DryRun:          true,
+				Loggers:         testLoggers,
+				Client:          fakeclient,
+			}
+			_, err := executor.ExecuteJobs(context.Background(), tc.jobs, []Filter{ChangedPresubmitFilter{}}, testPrNumber)
 
 			if err == nil {
 				t.Errorf("Expected to return error, got nil")
@@ -379,25 +447,9 @@ func TestExecuteJobsUnsuccessful(t *testing.T) {
 			testLoggers := Loggers{logrus.New(), logrus.New()}
 			fakecs := fake.NewSimpleClientset()
 			fakeclient := fakecs.ProwV1().ProwJobs(testNamespace)
-			watcher, err := fakeclient.Watch(metav1.ListOptions{})
-			if err != nil {
-				t.Fatalf("Failed to setup watch: %v", err)
-			}
-			fakecs.Fake.PrependWatchReactor("prowjobs", func(clientgo_testing.Action) (bool, watch.Interface, error) {
-				watcher.Stop()
-				n := 0
-				for _, jobs := range tc.jobs {
-					n += len(jobs)
-				}
-				ret := watch.NewFakeWithChanSize(n, true)
-				for event := range watcher.ResultChan() {
-					pj := event.Object.(*pjapi.ProwJob).DeepCopy()
-					pj.Status.State = tc.results[pj.Spec.Job]
-					ret.Modify(pj)
-				}
-				return true, ret, nil
-			})
-			success, _ := ExecuteJobs(tc.jobs, testPrNumber, testRepoPath, testRefs, true, testLoggers, fakeclient)
+			fakecs.Fake.PrependWatchReactor("prowjobs", makeFinishReactor(fakeclient, tc.results))
+			executor := &Executor{ReleaseRepoPath: testRepoPath, Refs: testRefs, DryRun: true, Loggers: testLoggers, Client: fakeclient}
+			success, _ := executor.ExecuteJobs(context.Background(), tc.jobs, []Filter{ChangedPresubmitFilter{}}, testPrNumber)
 
 			if success {
 				t.Errorf("Expected to return success=false, got true")
@@ -481,12 +533,9 @@ func TestExecuteJobsPositive(t *testing.T) {
 			testLoggers := Loggers{logrus.New(), logrus.New()}
 			fakecs := fake.NewSimpleClientset()
 			fakeclient := fakecs.ProwV1().ProwJobs(testNamespace)
-			watcher, err := fakeclient.Watch(metav1.ListOptions{})
-			if err != nil {
-				t.Fatalf("Failed to setup watch: %v", err)
-			}
-			fakecs.Fake.PrependWatchReactor("prowjobs", makeSuccessfulFinishReactor(watcher, tc.jobs))
-			success, err := ExecuteJobs(tc.jobs, testPrNumber, testRepoPath, testRefs, true, testLoggers, fakeclient)
+			fakecs.Fake.PrependWatchReactor("prowjobs", makeImmediateSuccessReactor(fakeclient))
+			executor := &Executor{ReleaseRepoPath: testRepoPath, Refs: testRefs, DryRun: true, Loggers: testLoggers, Client: fakeclient}
+			success, err := executor.ExecuteJobs(context.Background(), tc.jobs, []Filter{ChangedPresubmitFilter{}}, testPrNumber)
 
 			if err != nil {
 				t.Errorf("Expected ExecuteJobs() to not return error, returned %v", err)
@@ -520,6 +569,250 @@ func TestExecuteJobsPositive(t *testing.T) {
 	}
 }
 
+func TestExecuteJobsWithPolicy(t *testing.T) {
+	testPrNumber, testNamespace, testRepoPath, testRefs := makeTestData()
+	targetRepo := "targetOrg/targetRepo"
+	anotherTargetRepo := "anotherOrg/anotherRepo"
+
+	testCases := []struct {
+		description  string
+		policy       RehearsalPolicy
+		jobs         map[string][]prowconfig.Presubmit
+		expectedJobs []string
+	}{{
+		description: "ExcludeJobs drops a known-broken job regardless of the filter",
+		policy:      RehearsalPolicy{ExcludeJobs: []*regexp.Regexp{regexp.MustCompile("^job2$")}},
+		jobs: map[string][]prowconfig.Presubmit{targetRepo: {
+			*makeTestingPresubmit("job1", "ci/prow/job1", []string{"arg1"}),
+			*makeTestingPresubmit("job2", "ci/prow/job2", []string{"arg1"}),
+		}},
+		expectedJobs: []string{"rehearse-123-job1"},
+	}, {
+		description: "ExcludeRepos drops every job from that repo",
+		policy:      RehearsalPolicy{ExcludeRepos: []string{anotherTargetRepo}},
+		jobs: map[string][]prowconfig.Presubmit{
+			targetRepo:        {*makeTestingPresubmit("job1", "ci/prow/job1", []string{"arg1"})},
+			anotherTargetRepo: {*makeTestingPresubmit("job2", "ci/prow/job2", []string{"arg1"})},
+		},
+		expectedJobs: []string{"rehearse-123-job1"},
+	}, {
+		description: "MaxJobsPerRepo keeps the alphabetically-first jobs per repo",
+		policy:      RehearsalPolicy{MaxJobsPerRepo: 1},
+		jobs: map[string][]prowconfig.Presubmit{targetRepo: {
+			*makeTestingPresubmit("job1", "ci/prow/job1", []string{"arg1"}),
+			*makeTestingPresubmit("job2", "ci/prow/job2", []string{"arg1"}),
+		}},
+		expectedJobs: []string{"rehearse-123-job1"},
+	}, {
+		description: "MaxTotalJobs keeps the alphabetically-first jobs across repos",
+		policy:      RehearsalPolicy{MaxTotalJobs: 1},
+		jobs: map[string][]prowconfig.Presubmit{
+			targetRepo:        {*makeTestingPresubmit("job2", "ci/prow/job2", []string{"arg1"})},
+			anotherTargetRepo: {*makeTestingPresubmit("job1", "ci/prow/job1", []string{"arg1"})},
+		},
+		expectedJobs: []string{"rehearse-123-job1"},
+	}, {
+		description: "SkipIfPodSpecSizeBytes drops oversized PodSpecs",
+		policy:      RehearsalPolicy{SkipIfPodSpecSizeBytes: 1},
+		jobs: map[string][]prowconfig.Presubmit{targetRepo: {
+			*makeTestingPresubmit("job1", "ci/prow/job1", []string{"arg1"}),
+		}},
+		expectedJobs: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			testLoggers := Loggers{logrus.New(), logrus.New()}
+			fakecs := fake.NewSimpleClientset()
+			fakeclient := fakecs.ProwV1().ProwJobs(testNamespace)
+			fakecs.Fake.PrependWatchReactor("prowjobs", makeImmediateSuccessReactor(fakeclient))
+			executor := &Executor{Policy: tc.policy, ReleaseRepoPath: testRepoPath, Refs: testRefs, DryRun: true, Loggers: testLoggers, Client: fakeclient}
+			success, err := executor.ExecuteJobs(context.Background(), tc.jobs, []Filter{ChangedPresubmitFilter{}}, testPrNumber)
+			if err != nil {
+				t.Fatalf("Expected ExecuteJobs() to not return error, returned %v", err)
+			}
+			if !success {
+				t.Errorf("Expected ExecuteJobs() to return success=true, got false")
+			}
+
+			createdJobs, err := fakeclient.List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("Failed to get expected ProwJobs from fake client")
+			}
+			var names []string
+			for _, job := range createdJobs.Items {
+				names = append(names, job.Spec.Job)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tc.expectedJobs) {
+				t.Errorf("expected jobs %v, got %v", tc.expectedJobs, names)
+			}
+		})
+	}
+}
+
+// makeFinishReactor returns a watch reactor safe for concurrent invocation:
+// since ExecuteJobs now opens one watch per rehearsal job rather than a
+// single shared one, several can be outstanding at once. Each invocation
+// reads the job name from its own `metadata.name` field selector and
+// reports a terminal state for just that one job, so one job's watch can
+// never steal another's event. It never calls back into the fake client,
+// whose lock is held while a reactor runs. results picks that state per
+// job name (Spec.Job, which prowJobForRehearsal sets to the ProwJob's own
+// name); a job absent from results gets SuccessState.
+func makeFinishReactor(fakeclient pj.ProwJobInterface, results map[string]pjapi.ProwJobState) func(clientgo_testing.Action) (bool, watch.Interface, error) {
+	return func(action clientgo_testing.Action) (bool, watch.Interface, error) {
+		watchAction, ok := action.(clientgo_testing.WatchActionImpl)
+		if !ok {
+			return false, nil, nil
+		}
+		selector := watchAction.GetWatchRestrictions().Fields
+		if selector == nil {
+			return true, watch.NewEmptyWatch(), nil
+		}
+		name, found := selector.RequiresExactMatch("metadata.name")
+		if !found {
+			return true, watch.NewEmptyWatch(), nil
+		}
+
+		done := &pjapi.ProwJob{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       pjapi.ProwJobSpec{Job: name},
+		}
+		if state, ok := results[done.Spec.Job]; ok {
+			done.Status.State = state
+		} else {
+			done.Status.State = pjapi.SuccessState
+		}
+		ret := watch.NewFakeWithChanSize(1, true)
+		ret.Modify(done)
+		return true, ret, nil
+	}
+}
+
+// makeImmediateSuccessReactor is makeFinishReactor reporting SuccessState
+// for every job.
+func makeImmediateSuccessReactor(fakeclient pj.ProwJobInterface) func(clientgo_testing.Action) (bool, watch.Interface, error) {
+	return makeFinishReactor(fakeclient, nil)
+}
+
+func TestExecuteJobsConcurrencyLimit(t *testing.T) {
+	testPrNumber, testNamespace, testRepoPath, testRefs := makeTestData()
+	targetRepo := "targetOrg/targetRepo"
+	jobs := map[string][]prowconfig.Presubmit{targetRepo: {
+		*makeTestingPresubmit("job1", "ci/prow/job1", []string{"arg1"}),
+		*makeTestingPresubmit("job2", "ci/prow/job2", []string{"arg2"}),
+	}}
+
+	var mu sync.Mutex
+	var order []string
+	var watched int
+	fakecs := fake.NewSimpleClientset()
+	fakeclient := fakecs.ProwV1().ProwJobs(testNamespace)
+	fakecs.PrependReactor("create", "prowjobs", func(action clientgo_testing.Action) (bool, runtime.Object, error) {
+		pj := action.(clientgo_testing.CreateAction).GetObject().(*pjapi.ProwJob)
+		mu.Lock()
+		if outstanding := len(order) - watched; outstanding >= 1 {
+			t.Errorf("%s submitted while %d rehearsal(s) were still outstanding", pj.Spec.Job, outstanding)
+		}
+		order = append(order, pj.Spec.Job)
+		mu.Unlock()
+		return false, nil, nil
+	})
+	successReactor := makeImmediateSuccessReactor(fakeclient)
+	fakecs.Fake.PrependWatchReactor("prowjobs", func(action clientgo_testing.Action) (bool, watch.Interface, error) {
+		mu.Lock()
+		watched++
+		mu.Unlock()
+		return successReactor(action)
+	})
+
+	testLoggers := Loggers{logrus.New(), logrus.New()}
+	executor := &Executor{MaxConcurrent: 1, ReleaseRepoPath: testRepoPath, Refs: testRefs, DryRun: true, Loggers: testLoggers, Client: fakeclient}
+
+	success, err := executor.ExecuteJobs(context.Background(), jobs, []Filter{ChangedPresubmitFilter{}}, testPrNumber)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !success {
+		t.Fatalf("expected success=true")
+	}
+
+	expected := []string{"rehearse-123-job1", "rehearse-123-job2"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected jobs to be submitted one at a time in order %v, got %v", expected, order)
+	}
+}
+
+func TestExecuteJobsCancellation(t *testing.T) {
+	testPrNumber, testNamespace, testRepoPath, testRefs := makeTestData()
+	targetRepo := "targetOrg/targetRepo"
+	jobs := map[string][]prowconfig.Presubmit{targetRepo: {
+		*makeTestingPresubmit("job1", "ci/prow/job1", []string{"arg1"}),
+		*makeTestingPresubmit("job2", "ci/prow/job2", []string{"arg2"}),
+	}}
+
+	var mu sync.Mutex
+	var patched []string
+	fakecs := fake.NewSimpleClientset()
+	fakecs.PrependReactor("patch", "prowjobs", func(action clientgo_testing.Action) (bool, runtime.Object, error) {
+		name := action.(clientgo_testing.PatchAction).GetName()
+		mu.Lock()
+		patched = append(patched, name)
+		mu.Unlock()
+		return true, &pjapi.ProwJob{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     pjapi.ProwJobStatus{State: pjapi.AbortedState},
+		}, nil
+	})
+	fakeclient := fakecs.ProwV1().ProwJobs(testNamespace)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testLoggers := Loggers{logrus.New(), logrus.New()}
+	executor := &Executor{MaxConcurrent: 1, ReleaseRepoPath: testRepoPath, Refs: testRefs, DryRun: true, Loggers: testLoggers, Client: fakeclient}
+
+	success, err := executor.ExecuteJobs(ctx, jobs, []Filter{ChangedPresubmitFilter{}}, testPrNumber)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if success {
+		t.Errorf("expected success=false on cancellation")
+	}
+	if len(patched) == 0 {
+		t.Errorf("expected the outstanding rehearsal ProwJob to be patched Aborted, got none")
+	}
+}
+
+// watchReactorForNames returns a watch reactor that inspects the
+// `metadata.name` field selector each per-job watch is created with and
+// replays that job's own event script on a fresh fake watcher, so it
+// stands in for the per-name watches the apiserver would otherwise serve.
+// A watch whose selector doesn't match any scripted name (there shouldn't
+// be one) gets an empty watch.
+func watchReactorForNames(t *testing.T, events map[string][]*pjapi.ProwJob) func(clientgo_testing.Action) (bool, watch.Interface, error) {
+	t.Helper()
+	return func(action clientgo_testing.Action) (bool, watch.Interface, error) {
+		watchAction, ok := action.(clientgo_testing.WatchActionImpl)
+		if !ok {
+			t.Fatalf("expected a WatchActionImpl, got %T", action)
+		}
+		selector := watchAction.GetWatchRestrictions().Fields
+		for name, pjs := range events {
+			if selector == nil || !selector.Matches(fields.Set{"metadata.name": name}) {
+				continue
+			}
+			w := watch.NewFakeWithChanSize(len(pjs), true)
+			for _, j := range pjs {
+				w.Modify(j)
+			}
+			return true, w, nil
+		}
+		return true, watch.NewEmptyWatch(), nil
+	}
+}
+
 func TestWaitForJobs(t *testing.T) {
 	loggers := Loggers{logrus.New(), logrus.New()}
 	pjSuccess0 := pjapi.ProwJob{
@@ -535,7 +828,7 @@ func TestWaitForJobs(t *testing.T) {
 		Status:     pjapi.ProwJobStatus{State: pjapi.FailureState},
 	}
 	pjPending := pjapi.ProwJob{
-		ObjectMeta: metav1.ObjectMeta{Name: "pending"},
+		ObjectMeta: metav1.ObjectMeta{Name: "success0"},
 		Status:     pjapi.ProwJobStatus{State: pjapi.PendingState},
 	}
 	pjAborted := pjapi.ProwJob{
@@ -543,7 +836,7 @@ func TestWaitForJobs(t *testing.T) {
 		Status:     pjapi.ProwJobStatus{State: pjapi.AbortedState},
 	}
 	pjTriggered := pjapi.ProwJob{
-		ObjectMeta: metav1.ObjectMeta{Name: "triggered"},
+		ObjectMeta: metav1.ObjectMeta{Name: "success0"},
 		Status:     pjapi.ProwJobStatus{State: pjapi.TriggeredState},
 	}
 	pjError := pjapi.ProwJob{
@@ -552,8 +845,7 @@ func TestWaitForJobs(t *testing.T) {
 	}
 	testCases := []struct {
 		id      string
-		pjs     sets.String
-		events  []*pjapi.ProwJob
+		events  map[string][]*pjapi.ProwJob
 		success bool
 		err     error
 	}{{
@@ -562,53 +854,43 @@ func TestWaitForJobs(t *testing.T) {
 	}, {
 		id:      "one successful job",
 		success: true,
-		pjs:     sets.NewString("success0"),
-		events:  []*pjapi.ProwJob{&pjSuccess0},
+		events:  map[string][]*pjapi.ProwJob{"success0": {&pjSuccess0}},
 	}, {
-		id:  "mixed states",
-		pjs: sets.NewString("failure", "success0", "aborted", "error"),
-		events: []*pjapi.ProwJob{
-			&pjFailure, &pjPending, &pjSuccess0,
-			&pjTriggered, &pjAborted, &pjError,
+		id: "mixed states",
+		events: map[string][]*pjapi.ProwJob{
+			"failure":  {&pjFailure},
+			"success0": {&pjSuccess0},
+			"aborted":  {&pjAborted},
+			"error":    {&pjError},
 		},
 	}, {
 		id:      "ignored states",
 		success: true,
-		pjs:     sets.NewString("success0"),
-		events:  []*pjapi.ProwJob{&pjPending, &pjSuccess0, &pjTriggered},
+		events:  map[string][]*pjapi.ProwJob{"success0": {&pjPending, &pjSuccess0, &pjTriggered}},
 	}, {
 		id:      "repeated events",
 		success: true,
-		pjs:     sets.NewString("success0", "success1"),
-		events:  []*pjapi.ProwJob{&pjSuccess0, &pjSuccess0, &pjSuccess1},
-	}, {
-		id:  "repeated events with failure",
-		pjs: sets.NewString("success0", "success1", "failure"),
-		events: []*pjapi.ProwJob{
-			&pjSuccess0, &pjSuccess0,
-			&pjSuccess1, &pjFailure,
+		events: map[string][]*pjapi.ProwJob{
+			"success0": {&pjSuccess0, &pjSuccess0},
+			"success1": {&pjSuccess1},
 		},
 	}, {
-		id:      "not watched",
-		success: true,
-		pjs:     sets.NewString("success1"),
-		events:  []*pjapi.ProwJob{&pjSuccess0, &pjFailure, &pjSuccess1},
-	}, {
-		id:     "not watched failure",
-		pjs:    sets.NewString("failure"),
-		events: []*pjapi.ProwJob{&pjSuccess0, &pjFailure},
+		id: "repeated events with failure",
+		events: map[string][]*pjapi.ProwJob{
+			"success0": {&pjSuccess0, &pjSuccess0},
+			"success1": {&pjSuccess1},
+			"failure":  {&pjFailure},
+		},
 	}}
 	for _, tc := range testCases {
 		t.Run(tc.id, func(t *testing.T) {
-			w := watch.NewFakeWithChanSize(len(tc.events), true)
-			for _, j := range tc.events {
-				w.Modify(j)
+			pjs := sets.NewString()
+			for name := range tc.events {
+				pjs.Insert(name)
 			}
 			cs := fake.NewSimpleClientset()
-			cs.Fake.PrependWatchReactor("prowjobs", func(clientgo_testing.Action) (bool, watch.Interface, error) {
-				return true, w, nil
-			})
-			success, err := waitForJobs(tc.pjs, "", cs.ProwV1().ProwJobs("test"), loggers)
+			cs.Fake.PrependWatchReactor("prowjobs", watchReactorForNames(t, tc.events))
+			success, err := waitForJobs(pjs, "", cs.ProwV1().ProwJobs("test"), loggers)
 			if err != tc.err {
 				t.Fatalf("want `err` == %v, got %v", tc.err, err)
 			}
@@ -645,17 +927,18 @@ func TestWaitForJobsLog(t *testing.T) {
 	jobLogger, jobHook := logrustest.NewNullLogger()
 	dbgLogger, dbgHook := logrustest.NewNullLogger()
 	dbgLogger.SetLevel(logrus.DebugLevel)
-	w := watch.NewFakeWithChanSize(2, true)
-	w.Modify(&pjapi.ProwJob{
-		ObjectMeta: metav1.ObjectMeta{Name: "success"},
-		Status:     pjapi.ProwJobStatus{State: pjapi.SuccessState}})
-	w.Modify(&pjapi.ProwJob{
-		ObjectMeta: metav1.ObjectMeta{Name: "failure"},
-		Status:     pjapi.ProwJobStatus{State: pjapi.FailureState}})
+	events := map[string][]*pjapi.ProwJob{
+		"success": {{
+			ObjectMeta: metav1.ObjectMeta{Name: "success"},
+			Status:     pjapi.ProwJobStatus{State: pjapi.SuccessState},
+		}},
+		"failure": {{
+			ObjectMeta: metav1.ObjectMeta{Name: "failure"},
+			Status:     pjapi.ProwJobStatus{State: pjapi.FailureState},
+		}},
+	}
 	cs := fake.NewSimpleClientset()
-	cs.Fake.PrependWatchReactor("prowjobs", func(clientgo_testing.Action) (bool, watch.Interface, error) {
-		return true, w, nil
-	})
+	cs.Fake.PrependWatchReactor("prowjobs", watchReactorForNames(t, events))
 	loggers := Loggers{jobLogger, dbgLogger}
 	_, err := waitForJobs(sets.NewString("success", "failure"), "", cs.ProwV1().ProwJobs("test"), loggers)
 	if err != nil {
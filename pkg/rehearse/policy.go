@@ -0,0 +1,94 @@
+package rehearse
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+// RehearsalPolicy bounds which Presubmits a Filter selected are actually
+// allowed to be rehearsed, the way the Jenkins input plugin's
+// job_exclude/max_build_age/max_sub_jobs_layer knobs bound which builds
+// and parameters get surfaced: ExcludeJobs and ExcludeRepos give ops a
+// kill-switch for known-broken jobs without touching their configs, and
+// MaxJobsPerRepo/MaxTotalJobs/SkipIfPodSpecSizeBytes keep a mass
+// config-refactor PR from submitting hundreds of ProwJobs at once. The
+// zero value allows everything.
+type RehearsalPolicy struct {
+	// ExcludeJobs are patterns matched against a job's name; a match is
+	// skipped regardless of what any Filter said.
+	ExcludeJobs []*regexp.Regexp
+	// ExcludeRepos are repos whose jobs are skipped wholesale.
+	ExcludeRepos []string
+	// MaxJobsPerRepo caps how many rehearsals from the same repo are
+	// actually submitted. Zero means unbounded.
+	MaxJobsPerRepo int
+	// MaxTotalJobs caps how many rehearsals are actually submitted across
+	// all repos. Zero means unbounded.
+	MaxTotalJobs int
+	// SkipIfPodSpecSizeBytes skips any job whose PodSpec, JSON-encoded,
+	// would exceed this many bytes. Zero means unbounded.
+	SkipIfPodSpecSizeBytes int
+}
+
+// apply narrows pending down to what p allows. The result is always
+// sorted by job name first, so which jobs survive a MaxJobsPerRepo or
+// MaxTotalJobs cut is reproducible rather than depending on map
+// iteration order; everything that doesn't survive -- whether excluded
+// outright or cut for budget -- is named in a single Info log entry so PR
+// authors can see what was elided.
+func (p RehearsalPolicy) apply(pending []rehearsalRequest, loggers Loggers) []rehearsalRequest {
+	sort.Slice(pending, func(i, j int) bool { return pending[i].job.Name < pending[j].job.Name })
+
+	excludedRepos := sets.NewString(p.ExcludeRepos...)
+
+	var kept, skipped []rehearsalRequest
+	perRepo := map[string]int{}
+	for _, req := range pending {
+		switch {
+		case excludedRepos.Has(req.repo),
+			p.jobExcluded(req.job.Name),
+			p.podSpecTooLarge(req.job),
+			p.MaxTotalJobs > 0 && len(kept) >= p.MaxTotalJobs,
+			p.MaxJobsPerRepo > 0 && perRepo[req.repo] >= p.MaxJobsPerRepo:
+			skipped = append(skipped, req)
+		default:
+			kept = append(kept, req)
+			perRepo[req.repo]++
+		}
+	}
+
+	if len(skipped) > 0 {
+		names := make([]string, 0, len(skipped))
+		for _, req := range skipped {
+			names = append(names, req.job.Name)
+		}
+		loggers.Job.WithField("jobs", names).Info("skipped rehearsing some jobs per the rehearsal policy")
+	}
+
+	return kept
+}
+
+func (p RehearsalPolicy) jobExcluded(name string) bool {
+	for _, re := range p.ExcludeJobs {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RehearsalPolicy) podSpecTooLarge(job prowconfig.Presubmit) bool {
+	if p.SkipIfPodSpecSizeBytes <= 0 || job.Spec == nil {
+		return false
+	}
+	raw, err := json.Marshal(job.Spec)
+	if err != nil {
+		return false
+	}
+	return len(raw) > p.SkipIfPodSpecSizeBytes
+}
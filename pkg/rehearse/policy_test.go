@@ -0,0 +1,136 @@
+package rehearse
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+
+	v1 "k8s.io/api/core/v1"
+
+	prowconfig "k8s.io/test-infra/prow/config"
+)
+
+func makeTestingRehearsalRequest(repo, name string, podSpec *v1.PodSpec) rehearsalRequest {
+	return rehearsalRequest{
+		repo: repo,
+		job: prowconfig.Presubmit{
+			JobBase: prowconfig.JobBase{Name: name, Spec: podSpec},
+		},
+	}
+}
+
+func names(pending []rehearsalRequest) []string {
+	result := make([]string, 0, len(pending))
+	for _, req := range pending {
+		result = append(result, req.job.Name)
+	}
+	return result
+}
+
+func TestRehearsalPolicyApply(t *testing.T) {
+	smallSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "c"}}}
+
+	testCases := []struct {
+		description string
+		policy      RehearsalPolicy
+		pending     []rehearsalRequest
+		expected    []string
+	}{{
+		description: "zero-value policy allows everything, sorted by name",
+		pending: []rehearsalRequest{
+			makeTestingRehearsalRequest("org/repo", "b-job", smallSpec),
+			makeTestingRehearsalRequest("org/repo", "a-job", smallSpec),
+		},
+		expected: []string{"a-job", "b-job"},
+	}, {
+		description: "ExcludeJobs drops a matching job",
+		policy:      RehearsalPolicy{ExcludeJobs: []*regexp.Regexp{regexp.MustCompile("^broken-.*$")}},
+		pending: []rehearsalRequest{
+			makeTestingRehearsalRequest("org/repo", "broken-job", smallSpec),
+			makeTestingRehearsalRequest("org/repo", "fine-job", smallSpec),
+		},
+		expected: []string{"fine-job"},
+	}, {
+		description: "ExcludeRepos drops every job from that repo",
+		policy:      RehearsalPolicy{ExcludeRepos: []string{"org/excluded"}},
+		pending: []rehearsalRequest{
+			makeTestingRehearsalRequest("org/excluded", "job1", smallSpec),
+			makeTestingRehearsalRequest("org/kept", "job2", smallSpec),
+		},
+		expected: []string{"job2"},
+	}, {
+		description: "MaxJobsPerRepo caps each repo independently",
+		policy:      RehearsalPolicy{MaxJobsPerRepo: 1},
+		pending: []rehearsalRequest{
+			makeTestingRehearsalRequest("org/repo1", "a-job", smallSpec),
+			makeTestingRehearsalRequest("org/repo1", "b-job", smallSpec),
+			makeTestingRehearsalRequest("org/repo2", "c-job", smallSpec),
+		},
+		expected: []string{"a-job", "c-job"},
+	}, {
+		description: "MaxTotalJobs caps across repos",
+		policy:      RehearsalPolicy{MaxTotalJobs: 2},
+		pending: []rehearsalRequest{
+			makeTestingRehearsalRequest("org/repo1", "a-job", smallSpec),
+			makeTestingRehearsalRequest("org/repo2", "b-job", smallSpec),
+			makeTestingRehearsalRequest("org/repo1", "c-job", smallSpec),
+		},
+		expected: []string{"a-job", "b-job"},
+	}, {
+		description: "SkipIfPodSpecSizeBytes drops oversized PodSpecs",
+		policy:      RehearsalPolicy{SkipIfPodSpecSizeBytes: 10},
+		pending: []rehearsalRequest{
+			makeTestingRehearsalRequest("org/repo", "huge-job", &v1.PodSpec{
+				Containers: []v1.Container{{Name: "a-very-long-container-name-to-blow-the-budget"}},
+			}),
+			makeTestingRehearsalRequest("org/repo", "tiny-job", nil),
+		},
+		expected: []string{"tiny-job"},
+	}, {
+		description: "a job matched by more than one exclusion is dropped",
+		policy: RehearsalPolicy{
+			ExcludeJobs:  []*regexp.Regexp{regexp.MustCompile("^job$")},
+			ExcludeRepos: []string{"org/repo"},
+		},
+		pending:  []rehearsalRequest{makeTestingRehearsalRequest("org/repo", "job", smallSpec)},
+		expected: []string{},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			loggers := Loggers{logrus.New(), logrus.New()}
+			got := tc.policy.apply(tc.pending, loggers)
+			if !reflect.DeepEqual(names(got), tc.expected) {
+				t.Errorf("apply() = %v, want %v", names(got), tc.expected)
+			}
+		})
+	}
+}
+
+func TestRehearsalPolicyApplyLogsSkipped(t *testing.T) {
+	jobLogger, hook := logrustest.NewNullLogger()
+	loggers := Loggers{jobLogger, logrus.New()}
+
+	policy := RehearsalPolicy{ExcludeJobs: []*regexp.Regexp{regexp.MustCompile("^broken-job$")}}
+	pending := []rehearsalRequest{
+		makeTestingRehearsalRequest("org/repo", "broken-job", &v1.PodSpec{}),
+		makeTestingRehearsalRequest("org/repo", "fine-job", &v1.PodSpec{}),
+	}
+
+	policy.apply(pending, loggers)
+
+	for _, entry := range hook.Entries {
+		if entry.Level != logrus.InfoLevel {
+			continue
+		}
+		if jobs, ok := entry.Data["jobs"].([]string); ok {
+			if len(jobs) == 1 && jobs[0] == "broken-job" {
+				return
+			}
+		}
+	}
+	t.Error("expected an Info log entry naming the skipped job, found none")
+}